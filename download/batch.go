@@ -0,0 +1,113 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"runtime"
+	"sync"
+)
+
+// SourceResult is the outcome of downloading a single URL as part of a
+// DownloadAll batch.
+type SourceResult struct {
+	URL        string
+	Downloaded bool
+	Err        error
+}
+
+// Options configures a DownloadAll batch. SourceOptions is applied to every
+// URL in the batch.
+type Options struct {
+	SourceOptions
+	// Workers bounds the number of sources downloaded concurrently across
+	// the whole batch. Defaults to GOMAXPROCS.
+	Workers int
+	// PerHostLimit bounds how many requests may be in flight to a single
+	// host at once, so a batch spanning several mirrors doesn't hammer any
+	// one of them. Defaults to 2.
+	PerHostLimit int
+}
+
+func (o Options) withDefaults() Options {
+	o.SourceOptions = o.SourceOptions.withDefaults()
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+	if o.PerHostLimit <= 0 {
+		o.PerHostLimit = 2
+	}
+	return o
+}
+
+// DownloadAll downloads urls into dir concurrently, bounded by a shared
+// worker pool and per-host concurrency limits, and returns one SourceResult
+// per URL in the same order they were given. Errors from individual sources
+// are also combined with errors.Join into the returned error so callers that
+// only care whether the batch fully succeeded don't need to walk the slice.
+func DownloadAll(ctx context.Context, dir string, urls []string, opts Options) ([]SourceResult, error) {
+	opts = opts.withDefaults()
+
+	results := make([]SourceResult, len(urls))
+	hostSems := hostSemaphores(urls, opts.PerHostLimit)
+	workers := make(chan struct{}, opts.Workers)
+
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = SourceResult{URL: u, Err: ctx.Err()}
+				return
+			}
+			defer func() { <-workers }()
+
+			hostSem := hostSems[u]
+			if hostSem != nil {
+				select {
+				case hostSem <- struct{}{}:
+				case <-ctx.Done():
+					results[i] = SourceResult{URL: u, Err: ctx.Err()}
+					return
+				}
+				defer func() { <-hostSem }()
+			}
+
+			downloaded, err := DownloadSource(ctx, dir, u, opts.SourceOptions)
+			results[i] = SourceResult{URL: u, Downloaded: downloaded, Err: err}
+		}(i, u)
+	}
+	wg.Wait()
+
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// hostSemaphores builds one buffered channel per distinct host among urls,
+// each sized to limit, so concurrent downloads to the same host are capped
+// independently of the global worker pool. URLs that fail to parse are left
+// without a semaphore; DownloadSource will surface the parse error itself.
+func hostSemaphores(urls []string, limit int) map[string]chan struct{} {
+	byHost := make(map[string]chan struct{})
+	byURL := make(map[string]chan struct{}, len(urls))
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			continue
+		}
+		if _, ok := byHost[parsed.Host]; !ok {
+			byHost[parsed.Host] = make(chan struct{}, limit)
+		}
+		byURL[u] = byHost[parsed.Host]
+	}
+	return byURL
+}
@@ -0,0 +1,113 @@
+package download
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Decoder transparently decompresses a response body so that ASN/route
+// sources shipped compressed (CAIDA prefix2as, RIR stats, MRT dumps, ...)
+// don't require a separate manual decompression step.
+type Decoder interface {
+	// Accepts reports whether this decoder applies, given the resource URL
+	// and the response's Content-Encoding header (empty if absent).
+	Accepts(resourceURL string, contentEncoding string) bool
+	// Decode wraps r, a reader over the raw (still encoded) body.
+	Decode(r io.Reader) (io.Reader, error)
+}
+
+type gzipDecoder struct{}
+
+func (gzipDecoder) Accepts(resourceURL, contentEncoding string) bool {
+	return strings.HasSuffix(resourceURL, ".gz") || strings.EqualFold(contentEncoding, "gzip")
+}
+
+func (gzipDecoder) Decode(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+type bzip2Decoder struct{}
+
+func (bzip2Decoder) Accepts(resourceURL, contentEncoding string) bool {
+	return strings.HasSuffix(resourceURL, ".bz2") || strings.EqualFold(contentEncoding, "bzip2")
+}
+
+func (bzip2Decoder) Decode(r io.Reader) (io.Reader, error) {
+	return bzip2.NewReader(r), nil
+}
+
+type xzDecoder struct{}
+
+func (xzDecoder) Accepts(resourceURL, contentEncoding string) bool {
+	return strings.HasSuffix(resourceURL, ".xz") || strings.EqualFold(contentEncoding, "xz")
+}
+
+func (xzDecoder) Decode(r io.Reader) (io.Reader, error) {
+	return xz.NewReader(r)
+}
+
+// defaultDecoders covers the compression formats ASN/route sources are
+// typically shipped in.
+var defaultDecoders = []Decoder{gzipDecoder{}, bzip2Decoder{}, xzDecoder{}}
+
+// selectDecoder returns the first decoder willing to handle resourceURL /
+// contentEncoding, or nil if none applies.
+func selectDecoder(resourceURL string, contentEncoding string, decoders []Decoder) Decoder {
+	for _, d := range decoders {
+		if d.Accepts(resourceURL, contentEncoding) {
+			return d
+		}
+	}
+	return nil
+}
+
+// decodedPath strips a known compression suffix from fPath, or returns it
+// unchanged if none of the default suffixes match.
+func decodedPath(fPath string) string {
+	for _, suf := range []string{".gz", ".bz2", ".xz"} {
+		if strings.HasSuffix(fPath, suf) {
+			return strings.TrimSuffix(fPath, suf)
+		}
+	}
+	return fPath
+}
+
+// decodeFile decompresses src with dec and atomically writes the result to
+// dst (which may equal src, e.g. when the compression was only a
+// Content-Encoding wire transform rather than part of the resource's name).
+func decodeFile(src, dst string, dec Decoder) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for decoding: %v", src, err)
+	}
+	defer in.Close()
+
+	decoded, err := dec.Decode(in)
+	if err != nil {
+		return fmt.Errorf("failed to initialize decoder for %s: %v", src, err)
+	}
+
+	tmp := dst + ".swp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create file(%s): %v", tmp, err)
+	}
+	if _, err := io.Copy(out, decoded); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to decompress %s: %v", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close file(%s): %v", tmp, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", tmp, dst, err)
+	}
+	return nil
+}
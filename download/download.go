@@ -1,6 +1,10 @@
 package download
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +12,8 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,126 +22,438 @@ import (
 )
 
 var (
-	httpClient = &http.Client{}
+	// defaultHTTPClient is used whenever a caller doesn't supply its own via
+	// Options.Client, e.g. plain DownloadSource calls. Its Transport is
+	// tuned for talking to many independent mirrors concurrently.
+	defaultHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			ForceAttemptHTTP2:   true,
+		},
+	}
+
+	// Clock returns the current time and exists so RFC 7234 freshness
+	// calculations (max-age/Expires) can be made deterministic in tests.
+	Clock = time.Now
 )
 
+// cacheMeta is the sidecar metadata persisted next to a downloaded file so
+// later runs can revalidate against the origin instead of re-downloading it.
+type cacheMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+	MaxAge       *int      `json:"max_age_seconds,omitempty"`
+	// NoStore records a Cache-Control: no-store/no-cache directive, which
+	// forces revalidation regardless of any Expires also present.
+	NoStore   bool      `json:"no_store,omitempty"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// metaPath returns the sidecar path used to store caching metadata for fPath.
+func metaPath(fPath string) string {
+	return fPath + ".meta"
+}
+
+// loadCacheMeta reads the sidecar metadata for fPath. A missing sidecar is
+// not an error, it just means we have no cached metadata yet.
+func loadCacheMeta(fPath string) (*cacheMeta, error) {
+	data, err := os.ReadFile(metaPath(fPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read cache metadata(%s): %v", metaPath(fPath), err)
+	}
+	var m cacheMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse cache metadata(%s): %v", metaPath(fPath), err)
+	}
+	return &m, nil
+}
+
+// saveCacheMeta persists the sidecar metadata for fPath.
+func saveCacheMeta(fPath string, m *cacheMeta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache metadata(%s): %v", metaPath(fPath), err)
+	}
+	if err := os.WriteFile(metaPath(fPath), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cache metadata(%s): %v", metaPath(fPath), err)
+	}
+	return nil
+}
+
+// isFresh reports whether m is still fresh per RFC 7234: no-store/no-cache
+// always forces revalidation, a Cache-Control max-age takes priority over
+// Expires, and absent all three we must revalidate.
+func (m *cacheMeta) isFresh(now time.Time) bool {
+	if m == nil || m.NoStore {
+		return false
+	}
+	if m.MaxAge != nil {
+		return now.Before(m.FetchedAt.Add(time.Duration(*m.MaxAge) * time.Second))
+	}
+	if !m.Expires.IsZero() {
+		return now.Before(m.Expires)
+	}
+	return false
+}
+
+// parseCacheControl extracts the max-age directive and the no-store/no-cache
+// directives from a Cache-Control header value.
+func parseCacheControl(v string) (maxAge *int, noStore bool) {
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "no-store", part == "no-cache":
+			noStore = true
+		case strings.HasPrefix(part, "max-age"):
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if n, err := strconv.Atoi(strings.TrimSpace(kv[1])); err == nil {
+				maxAge = &n
+			}
+		}
+	}
+	return maxAge, noStore
+}
+
+// metaFromHeaders builds a cacheMeta from the response headers of a
+// successful (200, 206 or 304) response, timestamped at Clock().
+func metaFromHeaders(hdrs http.Header) cacheMeta {
+	m := cacheMeta{
+		ETag:      hdrs.Get("ETag"),
+		FetchedAt: Clock(),
+	}
+	if lm := hdrs.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			m.LastModified = t
+		}
+	}
+	if exp := hdrs.Get("Expires"); exp != "" {
+		if t, err := http.ParseTime(exp); err == nil {
+			m.Expires = t
+		}
+	}
+	if cc := hdrs.Get("Cache-Control"); cc != "" {
+		maxAge, noStore := parseCacheControl(cc)
+		m.NoStore = noStore
+		if !noStore {
+			m.MaxAge = maxAge
+		}
+	}
+	return m
+}
+
+// lastModFromHeaders extracts a modification time for resourceURL from its
+// response headers. Last-Modified is preferred when present; an ETag-only
+// mirror (common among RIR delegated stats and other httpcache-style
+// origins) falls back to Clock() instead of failing the download outright.
+// Only a response with neither validator is an error.
 func lastModFromHeaders(hdrs http.Header, resourceURL string) (t time.Time, err error) {
 	lastMod := hdrs.Get("Last-Modified")
 	if lastMod == "" {
-		return t, fmt.Errorf("no last modified time for URL: %s", resourceURL)
+		if hdrs.Get("ETag") != "" {
+			return Clock(), nil
+		}
+		return t, fmt.Errorf("no last-modified time or ETag for URL: %s", resourceURL)
 	}
-	t, err = time.Parse(time.RFC1123, lastMod)
+	// http.ParseTime accepts RFC1123, RFC850 and ANSI C timestamps, unlike
+	// time.Parse(time.RFC1123, ...) which rejects the latter two.
+	t, err = http.ParseTime(lastMod)
 	if err != nil {
 		return t, fmt.Errorf("couldn't parse last-modified time(%s) for URL(%s): %v", lastMod, resourceURL, err)
 	}
 	return t, nil
 }
 
-func CheckUpdate(resourceURL string, fileModTime time.Time) (bool, error) {
-	log.Logger.Debug("checking for update", zap.String("url", resourceURL))
-	req, err := http.NewRequest("HEAD", resourceURL, nil)
+// CheckUpdate reports whether the cached copy of resourceURL at fPath is
+// still fresh per its metadata sidecar, without making any network request.
+// A false result means the caller must revalidate with the origin; it does
+// not necessarily mean an update is available.
+func CheckUpdate(fPath string, resourceURL string) (fresh bool, meta *cacheMeta, err error) {
+	meta, err = loadCacheMeta(fPath)
 	if err != nil {
-		return false, fmt.Errorf("failed to prepare HEAD request to %s: %v", resourceURL, err)
+		return false, nil, err
 	}
-	res, err := httpClient.Do(req)
-	if err != nil {
-		return false, fmt.Errorf("HEAD request to %s failed: %v", resourceURL, err)
+	if meta.isFresh(Clock()) {
+		log.Logger.Debug("cached copy still fresh, skipping revalidation", zap.String("url", resourceURL))
+		return true, meta, nil
 	}
-	if res.StatusCode != 200 {
-		return false, fmt.Errorf("HEAD request to %s returned bad status: %d", resourceURL, res.StatusCode)
-	}
-	t, err := lastModFromHeaders(res.Header, resourceURL)
-	if err != nil {
-		return false, err
+	return false, meta, nil
+}
+
+// SourceOptions configures how a single source is fetched. The zero value
+// is valid and uses package defaults throughout.
+type SourceOptions struct {
+	// Client is the HTTP client used for every request this source needs
+	// (revalidation, the download itself, and fetching any sidecar
+	// integrity artifacts). Defaults to defaultHTTPClient.
+	Client *http.Client
+	// Verifier, if set, must pass before a downloaded file is renamed into
+	// place.
+	Verifier Verifier
+	// Retry configures retries of transient failures.
+	Retry RetryPolicy
+	// Progress, if set, is called as the response body is read.
+	Progress ProgressReporter
+	// Decoders are tried, in order, against the resource URL and response
+	// Content-Encoding to transparently decompress the downloaded payload.
+	// Defaults to defaultDecoders; pass a non-nil empty slice to disable
+	// decompression entirely.
+	Decoders []Decoder
+}
+
+func (o SourceOptions) withDefaults() SourceOptions {
+	if o.Client == nil {
+		o.Client = defaultHTTPClient
 	}
-	if !t.After(fileModTime) {
-		log.Logger.Debug("no update needed", zap.String("url", resourceURL),
-			zap.Time("urlTime", t), zap.Time("fileTime", fileModTime))
-		return false, nil
+	o.Retry = o.Retry.withDefaults()
+	if o.Decoders == nil {
+		o.Decoders = defaultDecoders
 	}
-	log.Logger.Debug("found update", zap.String("url", resourceURL),
-		zap.Time("urlTime", t), zap.Time("fileTime", fileModTime))
-	return true, nil
+	return o
 }
 
-// DownloadSource returns (downloaded, error)
-func DownloadSource(ourDir string, resourceURL string) (bool, error) {
-	wantDownload := true
+// DownloadSource downloads resourceURL into ourDir if it isn't already
+// fresh. ctx governs cancellation of the revalidation/download request. It
+// returns (downloaded, error).
+func DownloadSource(ctx context.Context, ourDir string, resourceURL string, opts SourceOptions) (bool, error) {
+	opts = opts.withDefaults()
 
 	u, err := url.Parse(resourceURL)
 	if err != nil {
 		return false, fmt.Errorf("couldn't parse resource URL(%s): %v", resourceURL, err)
 	}
 	fName := path.Base(u.Path)
-
 	fPath := path.Join(ourDir, fName)
-	fi, err := os.Stat(fPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			wantDownload = true
-		} else {
+
+	fExists := true
+	if _, err := os.Stat(fPath); err != nil {
+		if !os.IsNotExist(err) {
 			return false, fmt.Errorf("unexpected error stat'ing file(%s): %v", fPath, err)
 		}
-	} else {
-		wantDownload, err = CheckUpdate(resourceURL, fi.ModTime())
-		if err != nil {
-			return false, fmt.Errorf("checking for update(%s) failed: %v", resourceURL, err)
-		}
+		fExists = false
 	}
 
-	if !wantDownload {
+	fresh, meta, err := CheckUpdate(fPath, resourceURL)
+	if err != nil {
+		return false, fmt.Errorf("checking for update(%s) failed: %v", resourceURL, err)
+	}
+	// A fresh sidecar doesn't help if the data file it describes is gone:
+	// always fetch in that case rather than silently never re-downloading.
+	if fresh && fExists {
 		return false, nil
 	}
 
-	log.Logger.Debug("downloading", zap.String("url", resourceURL))
-	req, err := http.NewRequest("GET", resourceURL, nil)
-	if err != nil {
-		return false, fmt.Errorf("failed to prepare GET request to %s: %v", resourceURL, err)
+	var lastErr error
+	for attempt := 0; attempt < opts.Retry.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			log.Logger.Debug("retrying download", zap.String("url", resourceURL), zap.Int("attempt", attempt+1))
+		}
+
+		downloaded, statusCode, retryAfter, err := fetchOnce(ctx, opts, fPath, resourceURL, meta, fExists)
+		if err == nil {
+			return downloaded, nil
+		}
+		lastErr = err
+
+		retryable := isRetryableStatus(statusCode) || (statusCode == 0 && ctx.Err() == nil)
+		if !retryable || attempt == opts.Retry.MaxAttempts-1 {
+			break
+		}
+
+		delay := retryAfter
+		if delay == 0 {
+			delay = opts.Retry.backoff(attempt)
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return false, lastErr
+}
+
+// fetchOnce performs a single revalidate/resume/download attempt. statusCode
+// is 0 when the request failed or the response body could not be read in
+// full, so callers can tell a network error apart from an HTTP error status.
+// fExists reports whether
+// fPath is currently present on disk: when it isn't, the cached validators
+// are ignored entirely and an unconditional GET is issued, since a 304 or a
+// mishandled range response would otherwise leave the data file missing.
+func fetchOnce(ctx context.Context, opts SourceOptions, fPath, resourceURL string, meta *cacheMeta, fExists bool) (downloaded bool, statusCode int, retryAfter time.Duration, err error) {
+	client := opts.Client
+	swapPath := fPath + ".swp"
+
+	// A ranged resume is only safe when we have a validator to pin it to
+	// with If-Range: without one there's no way to tell the origin "only
+	// send me the range if this is still the same version I already have
+	// part of", and a resource change between runs would silently splice
+	// new-version bytes onto the stale prefix. Without a validator, a
+	// leftover partial is discarded and restarted from scratch.
+	var validator string
+	if fExists && meta != nil && meta.ETag != "" {
+		validator = meta.ETag
+	} else if fExists && meta != nil && !meta.LastModified.IsZero() {
+		validator = meta.LastModified.Format(http.TimeFormat)
 	}
-	res, err := httpClient.Do(req)
+
+	resuming := false
+	var resumeFrom int64
+	if validator != "" {
+		if fi, statErr := os.Stat(swapPath); statErr == nil && fi.Size() > 0 {
+			resuming = true
+			resumeFrom = fi.Size()
+		}
+	}
+
+	log.Logger.Debug("revalidating", zap.String("url", resourceURL))
+	req, err := http.NewRequestWithContext(ctx, "GET", resourceURL, nil)
 	if err != nil {
-		return false, fmt.Errorf("GET request to %s failed: %v", resourceURL, err)
+		return false, 0, 0, fmt.Errorf("failed to prepare GET request to %s: %v", resourceURL, err)
+	}
+	if resuming {
+		// Opportunistically resume; If-Range makes the origin fall back to
+		// a full 200 response rather than mixing bytes from two versions
+		// if the resource changed since the partial download started.
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", resumeFrom))
+		req.Header.Set("If-Range", validator)
+	} else if fExists && meta != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if !meta.LastModified.IsZero() {
+			req.Header.Set("If-Modified-Since", meta.LastModified.Format(http.TimeFormat))
+		}
 	}
-	if res.StatusCode != 200 {
-		return false, fmt.Errorf("GET request to %s returned bad status: %d", resourceURL, res.StatusCode)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, 0, 0, fmt.Errorf("GET request to %s failed: %v", resourceURL, err)
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNotModified {
+		log.Logger.Debug("no update needed", zap.String("url", resourceURL))
+		newMeta := metaFromHeaders(res.Header)
+		if newMeta.ETag == "" && meta != nil {
+			newMeta.ETag = meta.ETag
+		}
+		if newMeta.LastModified.IsZero() && meta != nil {
+			newMeta.LastModified = meta.LastModified
+		}
+		return false, res.StatusCode, 0, saveCacheMeta(fPath, &newMeta)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		delay, _ := retryAfterDelay(res.Header)
+		return false, res.StatusCode, delay, fmt.Errorf("GET request to %s returned bad status: %d", resourceURL, res.StatusCode)
+	}
+	// The origin didn't honor our Range/If-Range, either because the
+	// resource changed or because it doesn't support ranges at all: start
+	// over rather than appending onto a stale or partial prefix.
+	resuming = resuming && res.StatusCode == http.StatusPartialContent
+
 	t, err := lastModFromHeaders(res.Header, resourceURL)
 	if err != nil {
-		return false, err
+		return false, res.StatusCode, 0, err
 	}
 
-	swapPath := fPath + ".swp"
-	f, err := os.Create(swapPath)
+	sum256 := sha256.New()
+	sum512 := sha512.New()
+
+	var f *os.File
+	if resuming {
+		if existing, openErr := os.Open(swapPath); openErr == nil {
+			_, hashErr := io.Copy(io.MultiWriter(sum256, sum512), existing)
+			existing.Close()
+			if hashErr != nil {
+				return false, res.StatusCode, 0, fmt.Errorf("failed to hash existing partial file(%s): %v", swapPath, hashErr)
+			}
+			f, err = os.OpenFile(swapPath, os.O_WRONLY|os.O_APPEND, 0o644)
+		} else {
+			err = openErr
+		}
+	} else {
+		f, err = os.Create(swapPath)
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to create file(%s): %v", swapPath, err)
+		return false, res.StatusCode, 0, fmt.Errorf("failed to open file(%s): %v", swapPath, err)
 	}
 
-	_, err = io.Copy(f, res.Body)
+	var body io.Reader = res.Body
+	if opts.Progress != nil {
+		body = &progressReader{r: res.Body, total: res.ContentLength, start: Clock(), report: opts.Progress}
+	}
+	_, err = io.Copy(f, io.TeeReader(body, io.MultiWriter(sum256, sum512)))
 
 	if err != nil {
 		closeError := f.Close()
 		if closeError != nil {
 			closeError = fmt.Errorf("failed to close file(%s): %v", swapPath, closeError)
 		}
-		return false, errors.Join(closeError, fmt.Errorf("copy error: %v", err))
+		return false, 0, 0, errors.Join(closeError, fmt.Errorf("copy error: %v", err))
 	}
 
 	err = f.Close()
 	if err != nil {
-		return false, fmt.Errorf("close error: %v", err)
+		return false, res.StatusCode, 0, fmt.Errorf("close error: %v", err)
+	}
+
+	if opts.Verifier != nil {
+		verifyErr := opts.Verifier.Verify(VerifyInput{
+			Ctx:         ctx,
+			Client:      client,
+			ResourceURL: resourceURL,
+			Headers:     res.Header,
+			SwapPath:    swapPath,
+			SHA256:      sum256.Sum(nil),
+			SHA512:      sum512.Sum(nil),
+		})
+		if verifyErr != nil {
+			_ = os.Remove(swapPath)
+			return false, res.StatusCode, 0, &VerifyError{URL: resourceURL, Err: verifyErr}
+		}
 	}
 
 	err = os.Chtimes(swapPath, time.Time{}, t)
 	if err != nil {
-		return false, fmt.Errorf("chtimes error: %v", err)
+		return false, res.StatusCode, 0, fmt.Errorf("chtimes error: %v", err)
 	}
 
 	err = os.Rename(swapPath, fPath)
 	if err != nil {
-		return false, fmt.Errorf("failed to rename %s to %s: %v", swapPath, fPath, err)
+		return false, res.StatusCode, 0, fmt.Errorf("failed to rename %s to %s: %v", swapPath, fPath, err)
+	}
+
+	newMeta := metaFromHeaders(res.Header)
+	if newMeta.LastModified.IsZero() {
+		newMeta.LastModified = t
+	}
+	if err := saveCacheMeta(fPath, &newMeta); err != nil {
+		return false, res.StatusCode, 0, err
+	}
+
+	// decodedPath strips a recognized compression suffix (.gz/.bz2/.xz) so
+	// that case keeps both the raw artifact at fPath - checksum/signature
+	// sidecars are normally published against it, and it's what the resume
+	// validators above track - and a ready-to-use decompressed copy
+	// alongside it. When decompression was only signaled via
+	// Content-Encoding (no recognized suffix), decodedPath(fPath) == fPath
+	// and this intentionally replaces the raw transfer encoding with the
+	// decoded content, since that encoding carries no independent meaning.
+	if dec := selectDecoder(resourceURL, res.Header.Get("Content-Encoding"), opts.Decoders); dec != nil {
+		if err := decodeFile(fPath, decodedPath(fPath), dec); err != nil {
+			return true, res.StatusCode, 0, err
+		}
 	}
+
 	log.Logger.Debug("downloaded", zap.String("url", resourceURL))
-	return true, nil
+	return true, res.StatusCode, 0, nil
 }
@@ -0,0 +1,340 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestDownloadSource_RevalidatesAndHandlesNotModified(t *testing.T) {
+	const body = "hello world"
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		if requests > 1 {
+			if r.Header.Get("If-None-Match") != `"v1"` {
+				t.Errorf("expected If-None-Match on revalidation, got %q", r.Header.Get("If-None-Match"))
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	url := srv.URL + "/data.txt"
+
+	downloaded, err := DownloadSource(context.Background(), dir, url, SourceOptions{})
+	if err != nil {
+		t.Fatalf("first download: %v", err)
+	}
+	if !downloaded {
+		t.Fatal("expected the first download to report downloaded=true")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	if err != nil {
+		t.Fatalf("read downloaded file: %v", err)
+	}
+	if string(data) != body {
+		t.Fatalf("content = %q, want %q", data, body)
+	}
+
+	downloaded, err = DownloadSource(context.Background(), dir, url, SourceOptions{})
+	if err != nil {
+		t.Fatalf("second download: %v", err)
+	}
+	if downloaded {
+		t.Fatal("expected a 304 response to report downloaded=false")
+	}
+	if requests != 2 {
+		t.Fatalf("expected exactly 2 requests, got %d", requests)
+	}
+}
+
+func TestDownloadSource_ResumesPartialDownload(t *testing.T) {
+	const full = "0123456789ABCDEFGHIJ"
+	const already = 10
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != fmt.Sprintf("bytes=%d-", already) {
+			t.Errorf("expected a Range header resuming from byte %d, got %q", already, r.Header.Get("Range"))
+		}
+		if r.Header.Get("If-Range") != `"v1"` {
+			t.Errorf("expected If-Range validator, got %q", r.Header.Get("If-Range"))
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte(full[already:]))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	url := srv.URL + "/data.bin"
+	fPath := filepath.Join(dir, "data.bin")
+
+	// A previous version is already on disk, and a partial fetch of the
+	// next one died mid-copy, leaving a resumable swap file behind.
+	if err := os.WriteFile(fPath, []byte("previous version"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fPath+".swp", []byte(full[:already]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	meta := cacheMeta{ETag: `"v1"`, FetchedAt: time.Now()}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(metaPath(fPath), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded, err := DownloadSource(context.Background(), dir, url, SourceOptions{})
+	if err != nil {
+		t.Fatalf("resume download: %v", err)
+	}
+	if !downloaded {
+		t.Fatal("expected the resumed download to report downloaded=true")
+	}
+
+	got, err := os.ReadFile(fPath)
+	if err != nil {
+		t.Fatalf("read resumed file: %v", err)
+	}
+	if string(got) != full {
+		t.Fatalf("resumed content = %q, want %q", got, full)
+	}
+}
+
+func TestDownloadSource_RangeFallbackDiscardsStalePartial(t *testing.T) {
+	const stalePartial = "OLDOLDOLD!"
+	const newFull = "FRESHCONTENT1234567"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The origin doesn't honor Range/If-Range at all and always
+		// returns the full, changed representation.
+		w.Header().Set("ETag", `"v2"`)
+		_, _ = w.Write([]byte(newFull))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	url := srv.URL + "/data.bin"
+	fPath := filepath.Join(dir, "data.bin")
+
+	if err := os.WriteFile(fPath, []byte("placeholder"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fPath+".swp", []byte(stalePartial), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	meta := cacheMeta{ETag: `"v1"`, FetchedAt: time.Now()}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(metaPath(fPath), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	downloaded, err := DownloadSource(context.Background(), dir, url, SourceOptions{})
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if !downloaded {
+		t.Fatal("expected downloaded=true")
+	}
+
+	got, err := os.ReadFile(fPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != newFull {
+		t.Fatalf("content = %q, want %q (stale partial must not leak into the result)", got, newFull)
+	}
+}
+
+func TestChecksumSidecarVerifier(t *testing.T) {
+	const body = "integrity matters"
+	sum := sha256.Sum256([]byte(body))
+	goodDigest := hex.EncodeToString(sum[:])
+
+	newServer := func(digest string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			if strings.HasSuffix(r.URL.Path, ".sha256") {
+				fmt.Fprintln(w, digest)
+				return
+			}
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		srv := newServer(goodDigest)
+		defer srv.Close()
+		dir := t.TempDir()
+
+		downloaded, err := DownloadSource(context.Background(), dir, srv.URL+"/data.bin", SourceOptions{
+			Verifier: ChecksumSidecarVerifier{},
+		})
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		if !downloaded {
+			t.Fatal("expected downloaded=true")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "data.bin")); err != nil {
+			t.Fatalf("expected verified file on disk: %v", err)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		srv := newServer(strings.Repeat("0", 64))
+		defer srv.Close()
+		dir := t.TempDir()
+
+		_, err := DownloadSource(context.Background(), dir, srv.URL+"/data.bin", SourceOptions{
+			Verifier: ChecksumSidecarVerifier{},
+		})
+		var verr *VerifyError
+		if !errors.As(err, &verr) {
+			t.Fatalf("expected a *VerifyError, got %v", err)
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, "data.bin")); !os.IsNotExist(statErr) {
+			t.Fatal("expected no data file to be left behind after failed verification")
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, "data.bin.swp")); !os.IsNotExist(statErr) {
+			t.Fatal("expected the swap file to be removed after failed verification")
+		}
+	})
+}
+
+func TestDigestHeaderVerifier(t *testing.T) {
+	const body = "digest check"
+	sum := sha256.Sum256([]byte(body))
+	goodDigest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	badDigest := "sha-256=" + base64.StdEncoding.EncodeToString(sha256.New().Sum([]byte("wrong")))
+
+	newServer := func(digest string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Digest", digest)
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		srv := newServer(goodDigest)
+		defer srv.Close()
+		dir := t.TempDir()
+
+		downloaded, err := DownloadSource(context.Background(), dir, srv.URL+"/data.bin", SourceOptions{
+			Verifier: DigestHeaderVerifier{},
+		})
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		if !downloaded {
+			t.Fatal("expected downloaded=true")
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		srv := newServer(badDigest)
+		defer srv.Close()
+		dir := t.TempDir()
+
+		_, err := DownloadSource(context.Background(), dir, srv.URL+"/data.bin", SourceOptions{
+			Verifier: DigestHeaderVerifier{},
+		})
+		var verr *VerifyError
+		if !errors.As(err, &verr) {
+			t.Fatalf("expected a *VerifyError, got %v", err)
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, "data.bin")); !os.IsNotExist(statErr) {
+			t.Fatal("expected no data file to be left behind after failed verification")
+		}
+	})
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	entity, err := openpgp.NewEntity("tester", "", "tester@example.com", nil)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	keyring := openpgp.EntityList{entity}
+
+	const body = "signed payload"
+	var goodSig bytes.Buffer
+	if err := openpgp.ArmoredDetachedSign(&goodSig, entity, strings.NewReader(body), nil); err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	var badSig bytes.Buffer
+	if err := openpgp.ArmoredDetachedSign(&badSig, entity, strings.NewReader("tampered payload"), nil); err != nil {
+		t.Fatalf("sign tampered payload: %v", err)
+	}
+
+	newServer := func(sig []byte) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			if strings.HasSuffix(r.URL.Path, ".asc") {
+				_, _ = w.Write(sig)
+				return
+			}
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		srv := newServer(goodSig.Bytes())
+		defer srv.Close()
+		dir := t.TempDir()
+
+		downloaded, err := DownloadSource(context.Background(), dir, srv.URL+"/data.bin", SourceOptions{
+			Verifier: SignatureVerifier{Keyring: keyring},
+		})
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		if !downloaded {
+			t.Fatal("expected downloaded=true")
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		srv := newServer(badSig.Bytes())
+		defer srv.Close()
+		dir := t.TempDir()
+
+		_, err := DownloadSource(context.Background(), dir, srv.URL+"/data.bin", SourceOptions{
+			Verifier: SignatureVerifier{Keyring: keyring},
+		})
+		var verr *VerifyError
+		if !errors.As(err, &verr) {
+			t.Fatalf("expected a *VerifyError, got %v", err)
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, "data.bin")); !os.IsNotExist(statErr) {
+			t.Fatal("expected no data file to be left behind after failed verification")
+		}
+		if _, statErr := os.Stat(filepath.Join(dir, "data.bin.swp")); !os.IsNotExist(statErr) {
+			t.Fatal("expected the swap file to be removed after failed verification")
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package download
+
+import (
+	"io"
+	"time"
+)
+
+// ProgressReporter is called as a download's body is read. total is the
+// size advertised by Content-Length, or <= 0 if the server didn't send one
+// (in which case eta is always 0).
+type ProgressReporter func(read, total int64, eta time.Duration)
+
+// progressReader wraps an io.Reader and invokes a ProgressReporter after
+// every Read that returns data, estimating ETA from the average throughput
+// seen so far.
+type progressReader struct {
+	r      io.Reader
+	total  int64
+	read   int64
+	start  time.Time
+	report ProgressReporter
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.read += int64(n)
+		p.report(p.read, p.total, p.eta())
+	}
+	return n, err
+}
+
+func (p *progressReader) eta() time.Duration {
+	if p.read == 0 || p.total <= 0 {
+		return 0
+	}
+	elapsed := Clock().Sub(p.start)
+	rate := float64(p.read) / elapsed.Seconds()
+	if rate <= 0 {
+		return 0
+	}
+	remaining := float64(p.total - p.read)
+	if remaining <= 0 {
+		return 0
+	}
+	return time.Duration(remaining/rate) * time.Second
+}
@@ -0,0 +1,35 @@
+// Package progressbar provides a minimal terminal progress bar that
+// satisfies download.ProgressReporter.
+package progressbar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rspamd/goasn/download"
+)
+
+// New returns a download.ProgressReporter that renders a textual progress
+// bar of the given width to w on every call, e.g. "[====      ]  42% eta 3s"
+// for width 10. When total is unknown (<= 0) it prints only the number of
+// bytes read. A width <= 0 defaults to 40.
+func New(w io.Writer, width int) download.ProgressReporter {
+	if width <= 0 {
+		width = 40
+	}
+	return func(read, total int64, eta time.Duration) {
+		if total <= 0 {
+			fmt.Fprintf(w, "\r%d bytes read", read)
+			return
+		}
+		frac := float64(read) / float64(total)
+		if frac > 1 {
+			frac = 1
+		}
+		filled := int(frac * float64(width))
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+		fmt.Fprintf(w, "\r[%s] %3.0f%% eta %s", bar, frac*100, eta.Round(time.Second))
+	}
+}
@@ -0,0 +1,78 @@
+package download
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures how transient failures are retried. The zero value
+// is valid and uses the defaults documented on each field.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	// Defaults to 3.
+	MaxAttempts int
+	// BaseDelay is the starting backoff delay, doubled on each subsequent
+	// attempt and randomized by +/-50% jitter. Defaults to 500ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential delay before jitter is applied, so the
+	// returned delay can be up to 1.5x MaxDelay. Defaults to 30s.
+	MaxDelay time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 3
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 500 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 30 * time.Second
+	}
+	return p
+}
+
+// backoff returns the delay to wait before the given (0-based) retry
+// attempt, applying exponential growth and jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << attempt
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)+1)) - delay/2
+	delay += jitter
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// isRetryableStatus reports whether statusCode is a transient failure worth
+// retrying: request timeout, rate limiting, or a server-side error.
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfterDelay parses a Retry-After header (either delay-seconds or an
+// HTTP-date), returning ok=false if absent or unparseable.
+func retryAfterDelay(hdrs http.Header) (d time.Duration, ok bool) {
+	v := hdrs.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := time.ParseDuration(v + "s"); err == nil {
+		return secs, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+	return 0, false
+}
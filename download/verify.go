@@ -0,0 +1,179 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp" //nolint:staticcheck // no replacement ships detached-signature verification yet
+)
+
+// VerifyInput is everything a Verifier needs to check the integrity of a
+// file that was just downloaded to SwapPath but not yet renamed into place.
+type VerifyInput struct {
+	Ctx         context.Context
+	Client      *http.Client
+	ResourceURL string
+	Headers     http.Header
+	SwapPath    string
+	SHA256      []byte
+	SHA512      []byte
+}
+
+// Verifier checks the integrity of a downloaded source before it is allowed
+// to replace the previous copy on disk.
+type Verifier interface {
+	Verify(in VerifyInput) error
+}
+
+// VerifyError is returned by DownloadSource when a Verifier rejects a
+// download. The swap file has already been removed by the time it's
+// returned.
+type VerifyError struct {
+	URL string
+	Err error
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verification failed for %s: %v", e.URL, e.Err)
+}
+
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumSidecarVerifier verifies a download against a detached checksum
+// file published alongside it, e.g. "<url>.sha256" or "<url>.sha512"
+// containing a hex digest (optionally in "sha256sum"-style "<hex>  <name>"
+// form).
+type ChecksumSidecarVerifier struct {
+	// Suffix is the sidecar extension to fetch, e.g. ".sha256" or
+	// ".sha512". Defaults to ".sha256".
+	Suffix string
+}
+
+func (v ChecksumSidecarVerifier) Verify(in VerifyInput) error {
+	suffix := v.Suffix
+	if suffix == "" {
+		suffix = ".sha256"
+	}
+
+	want, err := fetchSidecarDigest(in.Ctx, in.Client, in.ResourceURL+suffix)
+	if err != nil {
+		return err
+	}
+
+	var got []byte
+	switch suffix {
+	case ".sha512":
+		got = in.SHA512
+	default:
+		got = in.SHA256
+	}
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("checksum mismatch: sidecar %s declares %x, downloaded content hashes to %x", suffix, want, got)
+	}
+	return nil
+}
+
+func fetchSidecarDigest(ctx context.Context, client *http.Client, sidecarURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", sidecarURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare GET request to %s: %v", sidecarURL, err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET request to %s failed: %v", sidecarURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET request to %s returned bad status: %d", sidecarURL, res.StatusCode)
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(res.Body); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", sidecarURL, err)
+	}
+	// Accept both a bare hex digest and the "sha256sum"-style "<hex>  <name>" form.
+	hexDigest := strings.Fields(buf.String())
+	if len(hexDigest) == 0 {
+		return nil, fmt.Errorf("sidecar %s is empty", sidecarURL)
+	}
+	digest, err := hex.DecodeString(hexDigest[0])
+	if err != nil {
+		return nil, fmt.Errorf("sidecar %s doesn't contain a hex digest: %v", sidecarURL, err)
+	}
+	return digest, nil
+}
+
+// DigestHeaderVerifier verifies a download against an RFC 3230 "Digest"
+// response header (e.g. "sha-256=<base64>"), avoiding any extra request.
+type DigestHeaderVerifier struct{}
+
+func (DigestHeaderVerifier) Verify(in VerifyInput) error {
+	header := in.Headers.Get("Digest")
+	if header == "" {
+		return fmt.Errorf("response carries no Digest header")
+	}
+	for _, part := range strings.Split(header, ",") {
+		algo, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		want, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(algo) {
+		case "sha-256":
+			if bytes.Equal(want, in.SHA256) {
+				return nil
+			}
+			return fmt.Errorf("sha-256 digest mismatch: header declares %x, downloaded content hashes to %x", want, in.SHA256)
+		case "sha-512":
+			if bytes.Equal(want, in.SHA512) {
+				return nil
+			}
+			return fmt.Errorf("sha-512 digest mismatch: header declares %x, downloaded content hashes to %x", want, in.SHA512)
+		}
+	}
+	return fmt.Errorf("Digest header %q contains no supported algorithm", header)
+}
+
+// SignatureVerifier verifies a download against a detached OpenPGP
+// signature published at "<url>.asc", checked against Keyring.
+type SignatureVerifier struct {
+	Keyring openpgp.EntityList
+}
+
+func (v SignatureVerifier) Verify(in VerifyInput) error {
+	sigURL := in.ResourceURL + ".asc"
+	req, err := http.NewRequestWithContext(in.Ctx, "GET", sigURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to prepare GET request to %s: %v", sigURL, err)
+	}
+	res, err := in.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("GET request to %s failed: %v", sigURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET request to %s returned bad status: %d", sigURL, res.StatusCode)
+	}
+
+	f, err := os.Open(in.SwapPath)
+	if err != nil {
+		return fmt.Errorf("failed to open downloaded file(%s) for signature check: %v", in.SwapPath, err)
+	}
+	defer f.Close()
+
+	if _, err := openpgp.CheckArmoredDetachedSignature(v.Keyring, f, res.Body, nil); err != nil {
+		return fmt.Errorf("signature verification against %s failed: %v", sigURL, err)
+	}
+	return nil
+}